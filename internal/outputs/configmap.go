@@ -0,0 +1,92 @@
+package outputs
+
+import (
+	yaml "gopkg.in/yaml.v1"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/camptocamp/prometheus-puppetdb/internal/types"
+)
+
+// OutputK8SConfigMap writes the discovered targets into a Kubernetes
+// ConfigMap, one data key per job.
+type OutputK8SConfigMap struct {
+	namespace string
+	name      string
+	clientset kubernetes.Interface
+}
+
+func setupOutputK8SConfigMap(namespace, name string) (Output, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutputK8SConfigMap{namespace: namespace, name: name, clientset: clientset}, nil
+}
+
+// WriteOutput writes all static configs to the ConfigMap's `targets.yml` key.
+func (o *OutputK8SConfigMap) WriteOutput(staticConfigs []types.StaticConfig) (err error) {
+	return o.WriteOutputs(map[string][]types.StaticConfig{"": staticConfigs})
+}
+
+// WriteOutputs writes one ConfigMap data key per job, named after the job.
+// A single job keeps the legacy `targets.yml` key, so upgrading an existing
+// single-job deployment doesn't change the key Prometheus is configured to
+// read.
+func (o *OutputK8SConfigMap) WriteOutputs(jobStaticConfigs map[string][]types.StaticConfig) (err error) {
+	data, err := marshalJobData(jobStaticConfigs)
+	if err != nil {
+		return err
+	}
+
+	configMaps := o.clientset.CoreV1().ConfigMaps(o.namespace)
+
+	configMap, err := configMaps.Get(o.name, metav1.GetOptions{})
+	if err != nil {
+		_, err = configMaps.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: o.name},
+			Data:       data,
+		})
+		return err
+	}
+
+	configMap.Data = data
+	_, err = configMaps.Update(configMap)
+	return err
+}
+
+// marshalJobData renders one job per ConfigMap data key, named after the
+// job. A single job is rendered to the legacy `targets.yml` key instead of
+// being named after the job, keeping single-job deployments working across
+// an upgrade.
+func marshalJobData(jobStaticConfigs map[string][]types.StaticConfig) (map[string]string, error) {
+	data := make(map[string]string, len(jobStaticConfigs))
+
+	if len(jobStaticConfigs) == 1 {
+		for _, staticConfigs := range jobStaticConfigs {
+			c, err := yaml.Marshal(&staticConfigs)
+			if err != nil {
+				return nil, err
+			}
+			data["targets.yml"] = string(c)
+		}
+		return data, nil
+	}
+
+	for jobName, staticConfigs := range jobStaticConfigs {
+		c, err := yaml.Marshal(&staticConfigs)
+		if err != nil {
+			return nil, err
+		}
+		data[jobName+".yml"] = string(c)
+	}
+	return data, nil
+}
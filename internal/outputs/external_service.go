@@ -0,0 +1,144 @@
+package outputs
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/camptocamp/prometheus-puppetdb/internal/types"
+)
+
+// managedByLabel marks the Services this output owns, so a reconcile pass
+// can tell them apart from unrelated Services in the namespace.
+const managedByLabel = "app.kubernetes.io/managed-by"
+const managedByValue = "prometheus-puppetdb"
+
+// OutputK8SExternalService mirrors each discovered target as a Kubernetes
+// ExternalName Service, so Prometheus' `kubernetes_sd_configs` (role:
+// service) can discover them without mounting a shared file or ConfigMap.
+type OutputK8SExternalService struct {
+	namespace    string
+	objectLabels map[string]string
+	clientset    kubernetes.Interface
+}
+
+func setupOutputK8SExternalService(namespace string, objectLabels map[string]string) (Output, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutputK8SExternalService{namespace: namespace, objectLabels: objectLabels, clientset: clientset}, nil
+}
+
+// WriteOutput mirrors each static config's target as a Service.
+func (o *OutputK8SExternalService) WriteOutput(staticConfigs []types.StaticConfig) (err error) {
+	return o.WriteOutputs(map[string][]types.StaticConfig{"": staticConfigs})
+}
+
+// WriteOutputs mirrors each job's static config targets as a Service, named
+// after the job and the target's index within it, then deletes any
+// previously-managed Service whose target is no longer discovered.
+func (o *OutputK8SExternalService) WriteOutputs(jobStaticConfigs map[string][]types.StaticConfig) (err error) {
+	desired := map[string]bool{}
+
+	for jobName, staticConfigs := range jobStaticConfigs {
+		for i, staticConfig := range staticConfigs {
+			for _, target := range staticConfig.Targets {
+				name, err := o.writeService(jobName, i, target)
+				if err != nil {
+					return err
+				}
+				desired[name] = true
+			}
+		}
+	}
+
+	return o.pruneServices(desired)
+}
+
+func (o *OutputK8SExternalService) writeService(jobName string, index int, target string) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host, portStr = target, "80"
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in target %q: %v", target, err)
+	}
+
+	name := fmt.Sprintf("prometheus-puppetdb-%d", index)
+	if jobName != "" {
+		name = fmt.Sprintf("prometheus-puppetdb-%s-%d", jobName, index)
+	}
+
+	spec := v1.ServiceSpec{
+		Type:         v1.ServiceTypeExternalName,
+		ExternalName: host,
+		Ports: []v1.ServicePort{
+			{Name: "metrics", Port: int32(port)},
+		},
+	}
+
+	services := o.clientset.CoreV1().Services(o.namespace)
+
+	existing, err := services.Get(name, metav1.GetOptions{})
+	if err != nil {
+		_, err = services.Create(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: o.serviceLabels(),
+			},
+			Spec: spec,
+		})
+		return name, err
+	}
+
+	existing.Labels = o.serviceLabels()
+	existing.Spec = spec
+	_, err = services.Update(existing)
+	return name, err
+}
+
+// pruneServices deletes every Service this output manages that isn't in the
+// current set of discovered targets.
+func (o *OutputK8SExternalService) pruneServices(desired map[string]bool) error {
+	services := o.clientset.CoreV1().Services(o.namespace)
+
+	list, err := services.List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", managedByLabel, managedByValue),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, svc := range list.Items {
+		if desired[svc.Name] {
+			continue
+		}
+		if err := services.Delete(svc.Name, &metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceLabels merges the user-configured object labels with the
+// owner label used to find managed Services during reconciliation.
+func (o *OutputK8SExternalService) serviceLabels() map[string]string {
+	labels := make(map[string]string, len(o.objectLabels)+1)
+	for k, v := range o.objectLabels {
+		labels[k] = v
+	}
+	labels[managedByLabel] = managedByValue
+	return labels
+}
@@ -0,0 +1,65 @@
+package outputs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v1"
+
+	"github.com/camptocamp/prometheus-puppetdb/internal/types"
+)
+
+// OutputFile writes the discovered targets to file_sd compatible YAML files.
+type OutputFile struct {
+	path string
+	dir  string
+}
+
+func setupOutputFile(path string) (Output, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no file path defined")
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &OutputFile{path: path, dir: dir}, nil
+}
+
+// WriteOutput writes all static configs to the configured file path.
+func (o *OutputFile) WriteOutput(staticConfigs []types.StaticConfig) (err error) {
+	c, err := yaml.Marshal(&staticConfigs)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(o.path, c, 0644)
+}
+
+// WriteOutputs writes one YAML file per job, under the configured file
+// path's parent directory, named after the job. A single job is written to
+// the configured file path directly instead of a job-named file, keeping
+// single-job deployments working across an upgrade.
+func (o *OutputFile) WriteOutputs(jobStaticConfigs map[string][]types.StaticConfig) (err error) {
+	if len(jobStaticConfigs) == 1 {
+		for _, staticConfigs := range jobStaticConfigs {
+			return o.WriteOutput(staticConfigs)
+		}
+	}
+
+	for jobName, staticConfigs := range jobStaticConfigs {
+		c, err := yaml.Marshal(&staticConfigs)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(o.dir, jobName+".yml")
+		if err = ioutil.WriteFile(path, c, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
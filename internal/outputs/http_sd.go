@@ -0,0 +1,189 @@
+package outputs
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/camptocamp/prometheus-puppetdb/internal/types"
+)
+
+type sdGroup struct {
+	body []byte
+	etag string
+}
+
+// OutputHTTPSD serves discovered targets over HTTP, compatible with
+// Prometheus' `http_sd_configs`. Each job is served as its own group, at
+// `<path>/<job_name>`; `<path>` itself serves every job's targets combined.
+type OutputHTTPSD struct {
+	path          string
+	basicAuthUser string
+	basicAuthPass string
+	tlsCertFile   string
+	tlsKeyFile    string
+
+	mu     sync.RWMutex
+	groups map[string]sdGroup
+	ready  bool
+}
+
+// setupOutputHTTPSD starts an HTTP server exposing the discovered targets
+// and returns the Output used to refresh them.
+func setupOutputHTTPSD(options *Options) (Output, error) {
+	path := options.SDPath
+	if path == "" {
+		path = "/targets"
+	}
+	// Only trim a trailing slash when there's more path left without it;
+	// trimming "/" itself down to "" leaves an invalid, empty ServeMux
+	// pattern.
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	o := &OutputHTTPSD{
+		path:          path,
+		basicAuthUser: options.BasicAuthUser,
+		basicAuthPass: options.BasicAuthPass,
+		tlsCertFile:   options.TLSCertFile,
+		tlsKeyFile:    options.TLSKeyFile,
+		groups:        map[string]sdGroup{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(o.path, o.withBasicAuth(o.serveTargets))
+	if o.path != "/" {
+		mux.HandleFunc(o.path+"/", o.withBasicAuth(o.serveTargets))
+	}
+	mux.HandleFunc("/-/healthy", o.serveHealthy)
+	mux.HandleFunc("/-/ready", o.serveReady)
+
+	listenAddress := options.ListenAddress
+	if listenAddress == "" {
+		listenAddress = ":9115"
+	}
+
+	go func() {
+		var err error
+		if o.tlsCertFile != "" && o.tlsKeyFile != "" {
+			err = http.ListenAndServeTLS(listenAddress, o.tlsCertFile, o.tlsKeyFile, mux)
+		} else {
+			err = http.ListenAndServe(listenAddress, mux)
+		}
+		log.Fatalf("http-sd server stopped: %v", err)
+	}()
+
+	return o, nil
+}
+
+// WriteOutput refreshes the single, unnamed group of targets served over
+// HTTP at the configured path.
+func (o *OutputHTTPSD) WriteOutput(staticConfigs []types.StaticConfig) (err error) {
+	return o.WriteOutputs(map[string][]types.StaticConfig{"": staticConfigs})
+}
+
+// WriteOutputs refreshes the per-job groups of targets served over HTTP,
+// each reachable at `<path>/<job_name>`, as well as the combined group
+// served at `<path>`.
+func (o *OutputHTTPSD) WriteOutputs(jobStaticConfigs map[string][]types.StaticConfig) (err error) {
+	groups := make(map[string]sdGroup, len(jobStaticConfigs)+1)
+
+	var combined []types.StaticConfig
+	for jobName, staticConfigs := range jobStaticConfigs {
+		combined = append(combined, staticConfigs...)
+
+		if jobName == "" {
+			continue
+		}
+		group, err := newSDGroup(staticConfigs)
+		if err != nil {
+			return err
+		}
+		groups[jobName] = group
+	}
+
+	group, err := newSDGroup(combined)
+	if err != nil {
+		return err
+	}
+	groups[""] = group
+
+	o.mu.Lock()
+	o.groups = groups
+	o.ready = true
+	o.mu.Unlock()
+
+	return
+}
+
+func newSDGroup(staticConfigs []types.StaticConfig) (group sdGroup, err error) {
+	body, err := json.Marshal(staticConfigs)
+	if err != nil {
+		return
+	}
+	group = sdGroup{
+		body: body,
+		etag: fmt.Sprintf("%x", sha256.Sum256(body)),
+	}
+	return
+}
+
+func (o *OutputHTTPSD) withBasicAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if o.basicAuthUser != "" || o.basicAuthPass != "" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != o.basicAuthUser || pass != o.basicAuthPass {
+				w.Header().Set("WWW-Authenticate", `Basic realm="prometheus-puppetdb"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (o *OutputHTTPSD) serveTargets(w http.ResponseWriter, r *http.Request) {
+	jobName := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, o.path), "/")
+
+	o.mu.RLock()
+	group, ok := o.groups[jobName]
+	o.mu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", group.etag)
+	if r.Header.Get("If-None-Match") == group.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(group.body)
+}
+
+func (o *OutputHTTPSD) serveHealthy(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "OK")
+}
+
+func (o *OutputHTTPSD) serveReady(w http.ResponseWriter, r *http.Request) {
+	o.mu.RLock()
+	ready := o.ready
+	o.mu.RUnlock()
+
+	if !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "OK")
+}
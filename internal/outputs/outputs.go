@@ -15,11 +15,21 @@ type Options struct {
 	ConfigMapName string
 	Namespace     string
 	ObjectLabels  map[string]string
+	// Used by HTTP SD
+	ListenAddress string
+	SDPath        string
+	TLSCertFile   string
+	TLSKeyFile    string
+	BasicAuthUser string
+	BasicAuthPass string
 }
 
 // Output is an abstraction to the different output types
 type Output interface {
 	WriteOutput(staticConfigs []types.StaticConfig) (err error)
+	// WriteOutputs writes one group of static configs per job, keyed by
+	// job name, letting a single deployment serve several scrape jobs.
+	WriteOutputs(jobStaticConfigs map[string][]types.StaticConfig) (err error)
 }
 
 // Setup returns an output type
@@ -33,6 +43,8 @@ func Setup(options *Options) (Output, error) {
 		return setupOutputK8SConfigMap(options.Namespace, options.ConfigMapName)
 	case "external-services":
 		return setupOutputK8SExternalService(options.Namespace, options.ObjectLabels)
+	case "http-sd":
+		return setupOutputHTTPSD(options)
 	case "":
 		return nil, fmt.Errorf("no output defined")
 	default:
@@ -0,0 +1,36 @@
+package outputs
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v1"
+
+	"github.com/camptocamp/prometheus-puppetdb/internal/types"
+)
+
+// OutputStdout prints the discovered targets to stdout as YAML.
+type OutputStdout struct{}
+
+// WriteOutput prints a single group of static configs to stdout.
+func (o *OutputStdout) WriteOutput(staticConfigs []types.StaticConfig) (err error) {
+	c, err := yaml.Marshal(&staticConfigs)
+	if err != nil {
+		return
+	}
+	fmt.Print(string(c))
+	return
+}
+
+// WriteOutputs prints each job's static configs to stdout as YAML, each
+// preceded by a `# job: <name>` comment line. No `---` document separator
+// is written between jobs.
+func (o *OutputStdout) WriteOutputs(jobStaticConfigs map[string][]types.StaticConfig) (err error) {
+	for jobName, staticConfigs := range jobStaticConfigs {
+		c, err := yaml.Marshal(&staticConfigs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# job: %s\n%s", jobName, string(c))
+	}
+	return
+}
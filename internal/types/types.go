@@ -0,0 +1,8 @@
+package types
+
+// StaticConfig represents a Prometheus static_config entry, as consumed by
+// file_sd_configs and http_sd_configs alike.
+type StaticConfig struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
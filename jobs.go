@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v1"
+)
+
+// Job describes a single PuppetDB scrape job: its own query, query type,
+// static labels and relabel_configs. It lets a single prometheus-puppetdb
+// deployment serve heterogeneous scrape jobs from a single PuppetDB.
+type Job struct {
+	JobName         string            `yaml:"job_name"`
+	Query           string            `yaml:"query"`
+	QueryType       string            `yaml:"query_type,omitempty"`
+	TargetParameter string            `yaml:"target_parameter,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty"`
+	RelabelConfigs  []RelabelConfig   `yaml:"relabel_configs,omitempty"`
+}
+
+func loadJobs(path string) (jobsList []Job, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(b, &jobsList); err != nil {
+		return
+	}
+
+	for _, job := range jobsList {
+		if err = validateRelabelConfigs(job.RelabelConfigs); err != nil {
+			return nil, fmt.Errorf("job %q: %v", job.JobName, err)
+		}
+	}
+	return
+}
+
+// defaultJobs builds the single implicit job described by the legacy
+// top-level flags, used when no --jobs-file is configured.
+func defaultJobs() []Job {
+	return []Job{
+		{
+			JobName:         "default",
+			Query:           cfg.Query,
+			QueryType:       cfg.QueryType,
+			TargetParameter: cfg.TargetParameter,
+			RelabelConfigs:  relabelConfigs,
+		},
+	}
+}
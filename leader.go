@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// leaderHealth tracks whether this replica currently holds the lease, so
+// followers can keep reporting liveness/readiness while staying idle.
+var leaderHealth int32
+
+func isLeader() bool {
+	return atomic.LoadInt32(&leaderHealth) == 1
+}
+
+func serveLeaderHealth(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "OK")
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if isLeader() {
+			fmt.Fprint(w, "OK (leader)")
+			return
+		}
+		fmt.Fprint(w, "OK (follower)")
+	})
+
+	go func() {
+		log.Fatalf("leader election health server stopped: %v", http.ListenAndServe(address, mux))
+	}()
+}
+
+// runWithLeaderElection runs `run` only while this replica holds the
+// configured Lease, so that several replicas of a `configmap` or
+// `external-services` deployment don't all race to write the same output.
+// `run` must return promptly once its context is canceled, so that losing
+// the lease actually stops the previous run before a new one starts.
+func runWithLeaderElection(leaseName, namespace, healthAddress string, run func(ctx context.Context)) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("failed to load in-cluster config for leader election: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("failed to create clientset for leader election: %v", err)
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("failed to determine leader election identity: %v", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	serveLeaderHealth(healthAddress)
+
+	var runDone chan struct{}
+
+	for {
+		leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					atomic.StoreInt32(&leaderHealth, 1)
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						run(ctx)
+					}()
+					runDone = done
+				},
+				OnStoppedLeading: func() {
+					atomic.StoreInt32(&leaderHealth, 0)
+					log.Warnf("%s lost leadership", identity)
+					if runDone != nil {
+						<-runDone
+					}
+				},
+			},
+		})
+	}
+}
@@ -2,57 +2,59 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
-	"strings"
 	"time"
 
-	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-
-	yaml "gopkg.in/yaml.v1"
-
 	log "github.com/sirupsen/logrus"
 
 	"github.com/jessevdk/go-flags"
+
+	"github.com/camptocamp/prometheus-puppetdb/internal/outputs"
 )
 
 var version = "undefined"
 var transport *http.Transport
 
 type Config struct {
-	Version       bool          `short:"V" long:"version" description:"Display version."`
-	PuppetDBURL   string        `short:"u" long:"puppetdb-url" description:"PuppetDB base URL." env:"PROMETHEUS_PUPPETDB_URL" default:"http://puppetdb:8080"`
-	CertFile      string        `short:"x" long:"cert-file" description:"A PEM encoded certificate file." env:"PROMETHEUS_CERT_FILE" default:"certs/client.pem"`
-	KeyFile       string        `short:"y" long:"key-file" description:"A PEM encoded private key file." env:"PROMETHEUS_KEY_FILE" default:"certs/client.key"`
-	CACertFile    string        `short:"z" long:"cacert-file" description:"A PEM encoded CA's certificate file." env:"PROMETHEUS_CACERT_FILE" default:"certs/cacert.pem"`
-	SSLSkipVerify bool          `short:"k" long:"ssl-skip-verify" description:"Skip SSL verification." env:"PROMETHEUS_SSL_SKIP_VERIFY"`
-	Query         string        `short:"q" long:"puppetdb-query" description:"PuppetDB query." env:"PROMETHEUS_PUPPETDB_QUERY" default:"facts[certname, value] { name='prometheus_exporters' and nodes { deactivated is null } }"`
-	Output        string        `short:"o" long:"output" description:"Output. One of stdout, file or configmap" env:"PROMETHEUS_PUPPETDB_OUTPUT" default:"stdout"`
-	File          string        `short:"f" long:"config-file" description:"Prometheus target file." env:"PROMETHEUS_PUPPETDB_FILE" default:"/etc/prometheus/targets/prometheus-puppetdb/targets.yml"`
-	ConfigMap     string        `long:"configmap" description:"Kubernetes ConfigMap to update." env:"PROMETHEUS_PUPPETDB_CONFIGMAP" default:"prometheus-puppetdb"`
-	NameSpace     string        `long:"namespace" description:"Kubernetes NameSpace to use." env:"PROMETHEUS_PUPPETDB_NAMESPACE" default:"default"`
-	Sleep         time.Duration `short:"s" long:"sleep" description:"Sleep time between queries." env:"PROMETHEUS_PUPPETDB_SLEEP" default:"5s"`
-	Manpage       bool          `short:"m" long:"manpage" description:"Output manpage."`
-}
-
-type Node struct {
-	Certname  string            `json:"certname"`
-	Exporters map[string]string `json:"value"`
-}
-
-type StaticConfig struct {
-	Targets []string          `yaml:"targets"`
-	Labels  map[string]string `yaml:"labels"`
+	Version         bool          `short:"V" long:"version" description:"Display version."`
+	PuppetDBURL     string        `short:"u" long:"puppetdb-url" description:"PuppetDB base URL." env:"PROMETHEUS_PUPPETDB_URL" default:"http://puppetdb:8080"`
+	CertFile        string        `short:"x" long:"cert-file" description:"A PEM encoded certificate file." env:"PROMETHEUS_CERT_FILE" default:"certs/client.pem"`
+	KeyFile         string        `short:"y" long:"key-file" description:"A PEM encoded private key file." env:"PROMETHEUS_KEY_FILE" default:"certs/client.key"`
+	CACertFile      string        `short:"z" long:"cacert-file" description:"A PEM encoded CA's certificate file." env:"PROMETHEUS_CACERT_FILE" default:"certs/cacert.pem"`
+	SSLSkipVerify   bool          `short:"k" long:"ssl-skip-verify" description:"Skip SSL verification." env:"PROMETHEUS_SSL_SKIP_VERIFY"`
+	Query           string        `short:"q" long:"puppetdb-query" description:"PuppetDB query." env:"PROMETHEUS_PUPPETDB_QUERY" default:"facts[certname, value] { name='prometheus_exporters' and nodes { deactivated is null } }"`
+	QueryType       string        `short:"t" long:"query-type" description:"PuppetDB query type. One of facts or resources" env:"PROMETHEUS_PUPPETDB_QUERY_TYPE" default:"facts"`
+	TargetParameter string        `long:"target-parameter" description:"Resource parameter (dotted, e.g. parameters.port) used to build the target for resources queries. Defaults to parameters.listen_address:parameters.port." env:"PROMETHEUS_PUPPETDB_TARGET_PARAMETER"`
+	TagSeparator    string        `long:"tag-separator" description:"Separator used to join a resource's tags in the __meta_puppetdb_tags label." env:"PROMETHEUS_PUPPETDB_TAG_SEPARATOR" default:","`
+	Output          string        `short:"o" long:"output" description:"Output. One of stdout, file, configmap, external-services or http-sd" env:"PROMETHEUS_PUPPETDB_OUTPUT" default:"stdout"`
+	File            string        `short:"f" long:"config-file" description:"Prometheus target file." env:"PROMETHEUS_PUPPETDB_FILE" default:"/etc/prometheus/targets/prometheus-puppetdb/targets.yml"`
+	ConfigMap       string        `long:"configmap" description:"Kubernetes ConfigMap to update." env:"PROMETHEUS_PUPPETDB_CONFIGMAP" default:"prometheus-puppetdb"`
+	NameSpace       string        `long:"namespace" description:"Kubernetes NameSpace to use." env:"PROMETHEUS_PUPPETDB_NAMESPACE" default:"default"`
+	Sleep           time.Duration `short:"s" long:"sleep" description:"Sleep time between queries." env:"PROMETHEUS_PUPPETDB_SLEEP" default:"5s"`
+	Manpage         bool          `short:"m" long:"manpage" description:"Output manpage."`
+
+	HTTPSDListenAddress string `long:"http-sd-listen-address" description:"Listen address for the http-sd output." env:"PROMETHEUS_PUPPETDB_HTTP_SD_LISTEN_ADDRESS" default:":9115"`
+	HTTPSDPath          string `long:"http-sd-path" description:"Path the http-sd output serves targets on." env:"PROMETHEUS_PUPPETDB_HTTP_SD_PATH" default:"/targets"`
+	HTTPSDTLSCertFile   string `long:"http-sd-tls-cert-file" description:"A PEM encoded certificate file for the http-sd output's TLS listener." env:"PROMETHEUS_PUPPETDB_HTTP_SD_TLS_CERT_FILE"`
+	HTTPSDTLSKeyFile    string `long:"http-sd-tls-key-file" description:"A PEM encoded private key file for the http-sd output's TLS listener." env:"PROMETHEUS_PUPPETDB_HTTP_SD_TLS_KEY_FILE"`
+	HTTPSDBasicAuthUser string `long:"http-sd-basic-auth-username" description:"Username required to query the http-sd output, if set." env:"PROMETHEUS_PUPPETDB_HTTP_SD_BASIC_AUTH_USERNAME"`
+	HTTPSDBasicAuthPass string `long:"http-sd-basic-auth-password" description:"Password required to query the http-sd output, if set." env:"PROMETHEUS_PUPPETDB_HTTP_SD_BASIC_AUTH_PASSWORD"`
+
+	RelabelConfigFile string `long:"relabel-config-file" description:"YAML file containing a list of relabel_configs, applied to each discovered target. Ignored when --jobs-file is set." env:"PROMETHEUS_PUPPETDB_RELABEL_CONFIG_FILE"`
+
+	JobsFile string `long:"jobs-file" description:"YAML file describing a list of jobs, each with its own query, query_type, labels and relabel_configs. Overrides --puppetdb-query and related flags." env:"PROMETHEUS_PUPPETDB_JOBS_FILE"`
+
+	LeaderElection              bool   `long:"leader-election" description:"Enable leader election for the configmap and external-services outputs, so only one replica writes at a time." env:"PROMETHEUS_PUPPETDB_LEADER_ELECTION"`
+	LeaderElectionLeaseName     string `long:"leader-election-lease-name" description:"Name of the Lease used for leader election." env:"PROMETHEUS_PUPPETDB_LEADER_ELECTION_LEASE_NAME" default:"prometheus-puppetdb"`
+	LeaderElectionNamespace     string `long:"leader-election-namespace" description:"Kubernetes namespace of the Lease used for leader election. Defaults to --namespace." env:"PROMETHEUS_PUPPETDB_LEADER_ELECTION_NAMESPACE"`
+	LeaderElectionHealthAddress string `long:"leader-election-health-address" description:"Listen address serving /-/healthy and /-/ready while leader election is enabled." env:"PROMETHEUS_PUPPETDB_LEADER_ELECTION_HEALTH_ADDRESS" default:":8181"`
 }
 
 type FileSdConfig struct {
@@ -61,7 +63,9 @@ type FileSdConfig struct {
 
 type RelabelConfig struct {
 	SourceLabels []string `yaml:"source_labels,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
 	Regex        string   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
 	Action       string   `yaml:"action,omitempty"`
 	TargetLabel  string   `yaml:"target_label,omitempty"`
 	Replacement  string   `yaml:"replacement,omitempty"`
@@ -99,67 +103,10 @@ func loadConfig(version string) (c Config, err error) {
 	return
 }
 
-func getNodes(client *http.Client, puppetdb string, query string) (nodes []Node, err error) {
-	form := strings.NewReader(fmt.Sprintf("{\"query\":\"%s\"}", query))
-	puppetdbURL := fmt.Sprintf("%s/pdb/query/v4", puppetdb)
-	req, err := http.NewRequest("POST", puppetdbURL, form)
-	if err != nil {
-		return
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-
-	err = json.Unmarshal(body, &nodes)
-	return
-}
-
-func getTargets() (c []byte, err error) {
-	fileSdConfig := []StaticConfig{}
-
-	nodes, err := getNodes(client, cfg.PuppetDBURL, cfg.Query)
-	if err != nil {
-		log.Errorf("failed to get nodes: %v", err)
-		return
-	}
-
-	for _, node := range nodes {
-		for jobName, target := range node.Exporters {
-			url, err := url.Parse(target)
-			if err != nil {
-				return nil, err
-			}
-			staticConfig := StaticConfig{
-				Targets: []string{url.Host},
-				Labels: map[string]string{
-					"certname":     node.Certname,
-					"host":         node.Certname,
-					"metrics_path": url.Path,
-					"job":          jobName,
-					"scheme":       url.Scheme,
-				},
-			}
-			fileSdConfig = append(fileSdConfig, staticConfig)
-		}
-	}
-	c, err = yaml.Marshal(&fileSdConfig)
-	if err != nil {
-		return
-	}
-
-	return
-}
-
 var client *http.Client
 var cfg Config
+var relabelConfigs []RelabelConfig
+var jobsList []Job
 
 func init() {
 	var err error
@@ -169,6 +116,22 @@ func init() {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
+	if cfg.RelabelConfigFile != "" {
+		relabelConfigs, err = loadRelabelConfigs(cfg.RelabelConfigFile)
+		if err != nil {
+			log.Fatalf("failed to load relabel config file: %v", err)
+		}
+	}
+
+	if cfg.JobsFile != "" {
+		jobsList, err = loadJobs(cfg.JobsFile)
+		if err != nil {
+			log.Fatalf("failed to load jobs file: %v", err)
+		}
+	} else {
+		jobsList = defaultJobs()
+	}
+
 	puppetdbURL, err := url.Parse(cfg.PuppetDBURL)
 	if err != nil {
 		log.Fatalf("failed to parse PuppetDB URL: %v", err)
@@ -209,89 +172,60 @@ func init() {
 }
 
 func main() {
+	output, err := outputs.Setup(&outputs.Options{
+		Name:          cfg.Output,
+		FilePath:      cfg.File,
+		ConfigMapName: cfg.ConfigMap,
+		Namespace:     cfg.NameSpace,
+
+		ListenAddress: cfg.HTTPSDListenAddress,
+		SDPath:        cfg.HTTPSDPath,
+		TLSCertFile:   cfg.HTTPSDTLSCertFile,
+		TLSKeyFile:    cfg.HTTPSDTLSKeyFile,
+		BasicAuthUser: cfg.HTTPSDBasicAuthUser,
+		BasicAuthPass: cfg.HTTPSDBasicAuthPass,
+	})
+	if err != nil {
+		log.Fatalf("failed to setup output: %v", err)
+	}
+
 	if cfg.Output == "stdout" {
-		c, err := getTargets()
+		jobStaticConfigs, err := getAllStaticConfigs()
 		if err != nil {
 			log.Fatalf("failed to get exporters: %v", err)
 		}
-		fmt.Printf(string(c))
+		if err = output.WriteOutputs(jobStaticConfigs); err != nil {
+			log.Fatalf("failed to write output: %v", err)
+		}
+		return
 	}
-	if cfg.Output == "file" {
-		os.MkdirAll(filepath.Dir(cfg.File), 0755)
+
+	runLoop := func(ctx context.Context) {
 		for {
-			c, err := getTargets()
+			jobStaticConfigs, err := getAllStaticConfigs()
 			if err != nil {
 				log.Errorf("failed to get exporters: %v", err)
-				break
+			} else if err = output.WriteOutputs(jobStaticConfigs); err != nil {
+				log.Errorf("failed to write output: %v", err)
 			}
 
-			err = ioutil.WriteFile(cfg.File, c, 0644)
-			if err != nil {
+			log.Infof("Sleeping for %v", cfg.Sleep)
+			select {
+			case <-time.After(cfg.Sleep):
+			case <-ctx.Done():
 				return
 			}
-
-			log.Infof("Sleeping for %v", cfg.Sleep)
-			time.Sleep(cfg.Sleep)
 		}
 	}
-	if cfg.Output == "configmap" {
-		// creates the in-cluster config
-		config, err := rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
-		}
-		// creates the clientset
-		clientset, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			panic(err.Error())
-		}
-
-		configMap, err := clientset.CoreV1().ConfigMaps(cfg.NameSpace).Get(cfg.ConfigMap, metav1.GetOptions{})
-		if err != nil {
-			configMap = &v1.ConfigMap{
-				TypeMeta: metav1.TypeMeta{
-					Kind:       "ConfigMap",
-					APIVersion: "v1",
-				},
-				ObjectMeta: metav1.ObjectMeta{
-					Name: cfg.ConfigMap,
-				},
-				Data: map[string]string{
-					"targets.yml": "",
-				},
-			}
-			configMap, err = clientset.CoreV1().ConfigMaps(cfg.NameSpace).Create(configMap)
-			if err != nil {
-				log.Fatalf("Unable to create ConfigMap: %v", err)
-			}
-		}
-
-		for {
-			c, err := getTargets()
-			if err != nil {
-				log.Errorf("failed to get exporters: %v", err)
-				break
-			}
-
-			configMap := &v1.ConfigMap{
-				TypeMeta: metav1.TypeMeta{
-					Kind:       "ConfigMap",
-					APIVersion: "v1",
-				},
-				ObjectMeta: metav1.ObjectMeta{
-					Name: cfg.ConfigMap,
-				},
-				Data: map[string]string{
-					"targets.yml": string(c),
-				},
-			}
-			configMap, err = clientset.CoreV1().ConfigMaps(cfg.NameSpace).Update(configMap)
-			if err != nil {
-				log.Fatalf("Unable to update ConfigMap.")
-			}
 
-			log.Infof("Sleeping for %v", cfg.Sleep)
-			time.Sleep(cfg.Sleep)
+	if cfg.LeaderElection && (cfg.Output == "configmap" || cfg.Output == "external-services") {
+		leaderElectionNamespace := cfg.LeaderElectionNamespace
+		if leaderElectionNamespace == "" {
+			leaderElectionNamespace = cfg.NameSpace
 		}
+		runWithLeaderElection(cfg.LeaderElectionLeaseName, leaderElectionNamespace, cfg.LeaderElectionHealthAddress, runLoop)
+		return
 	}
+
+	runLoop(context.Background())
 }
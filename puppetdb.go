@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/camptocamp/prometheus-puppetdb/internal/types"
+)
+
+// Node is a PuppetDB node returned by a `facts` query, exposing a
+// `prometheus_exporters` fact shaped as a map of job name to target URL.
+type Node struct {
+	Certname  string            `json:"certname"`
+	Exporters map[string]string `json:"value"`
+}
+
+// Resource is a PuppetDB resource returned by a `resources` query.
+type Resource struct {
+	Certname    string                 `json:"certname"`
+	Resource    string                 `json:"resource"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Exported    bool                   `json:"exported"`
+	Tags        []string               `json:"tags"`
+	File        string                 `json:"file"`
+	Environment string                 `json:"environment"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// StaticConfig is a Prometheus static_config entry.
+type StaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+func queryPuppetDB(client *http.Client, puppetdb string, query string, v interface{}) (err error) {
+	form := strings.NewReader(fmt.Sprintf("{\"query\":\"%s\"}", query))
+	puppetdbURL := fmt.Sprintf("%s/pdb/query/v4", puppetdb)
+	req, err := http.NewRequest("POST", puppetdbURL, form)
+	if err != nil {
+		return
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func getNodes(client *http.Client, puppetdb string, query string) (nodes []Node, err error) {
+	err = queryPuppetDB(client, puppetdb, query, &nodes)
+	return
+}
+
+func getResources(client *http.Client, puppetdb string, query string) (resources []Resource, err error) {
+	err = queryPuppetDB(client, puppetdb, query, &resources)
+	return
+}
+
+// resourceTarget derives a host:port target from a resource's parameters,
+// following the dotted `targetParameter` (e.g. `parameters.port`). When
+// `targetParameter` is empty, it falls back to PuppetDB's reported
+// `parameters.listen_address:parameters.port`. A `targetParameter` whose
+// value doesn't already carry a host (e.g. `parameters.port`, a bare port
+// number) is combined with `parameters.listen_address`.
+func resourceTarget(parameters map[string]interface{}, targetParameter string) string {
+	if targetParameter == "" {
+		return fmt.Sprintf("%v:%v", parameters["listen_address"], parameters["port"])
+	}
+
+	key := strings.TrimPrefix(targetParameter, "parameters.")
+	value := fmt.Sprintf("%v", parameters[key])
+	// A bare colon is taken to mean the parameter already holds a host:port
+	// pair. This assumes `targetParameter` points at a host-ish field; it
+	// would misfire for a colon-containing value that isn't one (e.g. an
+	// IPv6-only address with no port), treating it as complete instead of
+	// combining it with listen_address.
+	if strings.Contains(value, ":") {
+		return value
+	}
+
+	return fmt.Sprintf("%v:%v", parameters["listen_address"], value)
+}
+
+func getStaticConfigsFromFacts(job Job) (staticConfigs []StaticConfig, err error) {
+	nodes, err := getNodes(client, cfg.PuppetDBURL, job.Query)
+	if err != nil {
+		log.Errorf("failed to get nodes for job %q: %v", job.JobName, err)
+		return
+	}
+
+	for _, node := range nodes {
+		for jobName, target := range node.Exporters {
+			targetURL, err := url.Parse(target)
+			if err != nil {
+				return nil, err
+			}
+			staticConfigs = append(staticConfigs, StaticConfig{
+				Targets: []string{targetURL.Host},
+				Labels: map[string]string{
+					"__address__":  targetURL.Host,
+					"certname":     node.Certname,
+					"host":         node.Certname,
+					"metrics_path": targetURL.Path,
+					"job":          jobName,
+					"scheme":       targetURL.Scheme,
+				},
+			})
+		}
+	}
+	return
+}
+
+func getStaticConfigsFromResources(job Job) (staticConfigs []StaticConfig, err error) {
+	resources, err := getResources(client, cfg.PuppetDBURL, job.Query)
+	if err != nil {
+		log.Errorf("failed to get resources for job %q: %v", job.JobName, err)
+		return
+	}
+
+	for _, resource := range resources {
+		target := resourceTarget(resource.Parameters, job.TargetParameter)
+		staticConfigs = append(staticConfigs, StaticConfig{
+			Targets: []string{target},
+			Labels: map[string]string{
+				"__address__":                 target,
+				"__meta_puppetdb_certname":    resource.Certname,
+				"__meta_puppetdb_resource":    resource.Resource,
+				"__meta_puppetdb_type":        resource.Type,
+				"__meta_puppetdb_title":       resource.Title,
+				"__meta_puppetdb_exported":    fmt.Sprintf("%t", resource.Exported),
+				"__meta_puppetdb_tags":        strings.Join(resource.Tags, cfg.TagSeparator),
+				"__meta_puppetdb_file":        resource.File,
+				"__meta_puppetdb_environment": resource.Environment,
+				"__meta_puppetdb_query":       job.Query,
+			},
+		})
+	}
+	return
+}
+
+// getJobStaticConfigs runs a single job's query, merges its static labels
+// into every resulting target and applies its relabel_configs.
+func getJobStaticConfigs(job Job) (staticConfigs []StaticConfig, err error) {
+	switch job.QueryType {
+	case "resources":
+		staticConfigs, err = getStaticConfigsFromResources(job)
+	case "facts", "":
+		staticConfigs, err = getStaticConfigsFromFacts(job)
+	default:
+		return nil, fmt.Errorf("unknown query type: `%s'", job.QueryType)
+	}
+	if err != nil {
+		return
+	}
+
+	for i, staticConfig := range staticConfigs {
+		for name, value := range job.Labels {
+			staticConfig.Labels[name] = value
+		}
+		staticConfigs[i] = staticConfig
+	}
+
+	staticConfigs = applyRelabelConfigs(staticConfigs, job.RelabelConfigs)
+	return
+}
+
+// getAllStaticConfigs runs every configured job's query and returns its
+// targets keyed by job name. A failing job is logged and skipped rather
+// than aborting the whole cycle, so one misconfigured or transiently
+// failing job doesn't starve refresh of every other job.
+func getAllStaticConfigs() (jobStaticConfigs map[string][]types.StaticConfig, err error) {
+	jobStaticConfigs = make(map[string][]types.StaticConfig, len(jobsList))
+
+	for _, job := range jobsList {
+		staticConfigs, err := getJobStaticConfigs(job)
+		if err != nil {
+			log.Errorf("skipping job %q: %v", job.JobName, err)
+			continue
+		}
+		jobStaticConfigs[job.JobName] = toOutputStaticConfigs(staticConfigs)
+	}
+	return
+}
+
+func toOutputStaticConfigs(staticConfigs []StaticConfig) (out []types.StaticConfig) {
+	for _, staticConfig := range staticConfigs {
+		out = append(out, types.StaticConfig{
+			Targets: staticConfig.Targets,
+			Labels:  staticConfig.Labels,
+		})
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v1"
+)
+
+func loadRelabelConfigs(path string) (configs []RelabelConfig, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(b, &configs); err != nil {
+		return
+	}
+
+	err = validateRelabelConfigs(configs)
+	return
+}
+
+// validateRelabelConfigs compiles every rule's regex, so that a typo in a
+// relabel_configs file is reported at startup instead of silently dropping
+// the offending rule at relabel time.
+func validateRelabelConfigs(configs []RelabelConfig) error {
+	for _, rc := range configs {
+		regex := rc.Regex
+		if regex == "" {
+			regex = "(.*)"
+		}
+		if _, err := regexp.Compile("^(?:" + regex + ")$"); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", rc.Regex, err)
+		}
+	}
+	return nil
+}
+
+// applyRelabelConfigs runs each StaticConfig's label set through the
+// configured relabel_configs, in the same order and with the same
+// semantics as Prometheus' own relabeling, and drops any StaticConfig
+// excluded by a `keep`/`drop`-family action. It assumes each StaticConfig's
+// Labels map already carries an `__address__` label derived from the
+// target's host, and strips any remaining `__`-prefixed labels before
+// returning. Replacements expand `$N` group references only, and
+// `target_label` is used as given, without expansion.
+func applyRelabelConfigs(staticConfigs []StaticConfig, configs []RelabelConfig) []StaticConfig {
+	if len(configs) == 0 {
+		return stripMetaLabels(staticConfigs)
+	}
+
+	out := make([]StaticConfig, 0, len(staticConfigs))
+	for _, staticConfig := range staticConfigs {
+		labels, keep := relabel(staticConfig.Labels, configs)
+		if !keep {
+			continue
+		}
+		staticConfig.Labels = labels
+		if address, ok := labels["__address__"]; ok {
+			staticConfig.Targets = []string{address}
+		}
+		out = append(out, staticConfig)
+	}
+	return stripMetaLabels(out)
+}
+
+func relabel(labels map[string]string, configs []RelabelConfig) (map[string]string, bool) {
+	labels = cloneLabels(labels)
+
+	for _, rc := range configs {
+		separator := rc.Separator
+		if separator == "" {
+			separator = ";"
+		}
+		regex := rc.Regex
+		if regex == "" {
+			regex = "(.*)"
+		}
+		re, err := regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			continue
+		}
+		replacement := rc.Replacement
+		if replacement == "" {
+			replacement = "$1"
+		}
+
+		values := make([]string, len(rc.SourceLabels))
+		for i, name := range rc.SourceLabels {
+			values[i] = labels[name]
+		}
+		val := strings.Join(values, separator)
+
+		action := rc.Action
+		if action == "" {
+			action = "replace"
+		}
+
+		switch action {
+		case "replace":
+			match := re.FindStringSubmatch(val)
+			if match == nil || rc.TargetLabel == "" {
+				continue
+			}
+			labels[rc.TargetLabel] = expand(replacement, match)
+		case "keep":
+			if !re.MatchString(val) {
+				return nil, false
+			}
+		case "drop":
+			if re.MatchString(val) {
+				return nil, false
+			}
+		case "keepequal":
+			if val != labels[rc.TargetLabel] {
+				return nil, false
+			}
+		case "dropequal":
+			if val == labels[rc.TargetLabel] {
+				return nil, false
+			}
+		case "hashmod":
+			if rc.TargetLabel == "" || rc.Modulus == 0 {
+				continue
+			}
+			sum := md5.Sum([]byte(val))
+			labels[rc.TargetLabel] = strconv.FormatUint(binary.BigEndian.Uint64(sum[8:])%rc.Modulus, 10)
+		case "labelmap":
+			renamed := map[string]string{}
+			for name, value := range labels {
+				if match := re.FindStringSubmatch(name); match != nil {
+					renamed[expand(replacement, match)] = value
+				}
+			}
+			for name, value := range renamed {
+				labels[name] = value
+			}
+		case "labeldrop":
+			for name := range labels {
+				if re.MatchString(name) {
+					delete(labels, name)
+				}
+			}
+		case "labelkeep":
+			for name := range labels {
+				if !re.MatchString(name) {
+					delete(labels, name)
+				}
+			}
+		case "lowercase":
+			if rc.TargetLabel == "" {
+				continue
+			}
+			labels[rc.TargetLabel] = strings.ToLower(val)
+		case "uppercase":
+			if rc.TargetLabel == "" {
+				continue
+			}
+			labels[rc.TargetLabel] = strings.ToUpper(val)
+		}
+	}
+
+	return labels, true
+}
+
+func expand(replacement string, match []string) string {
+	out := replacement
+	for i, group := range match {
+		out = strings.Replace(out, fmt.Sprintf("$%d", i), group, -1)
+	}
+	return out
+}
+
+func cloneLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+func stripMetaLabels(staticConfigs []StaticConfig) []StaticConfig {
+	for i, staticConfig := range staticConfigs {
+		for name := range staticConfig.Labels {
+			if strings.HasPrefix(name, "__") {
+				delete(staticConfig.Labels, name)
+			}
+		}
+		staticConfigs[i] = staticConfig
+	}
+	return staticConfigs
+}